@@ -3,16 +3,39 @@ package apitest
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/xeipuuv/gojsonschema"
 )
 
+// updateGolden is set via the "-apitest.update" test flag. When true, RunHandlerTest writes the
+// observed response to its golden file instead of comparing against it.
+var updateGolden = flag.Bool("apitest.update", false, "update apitest golden files instead of comparing against them")
+
+// benchRuns is set via the "-apitest.bench" test flag. When greater than 1, each HandlerTest is run
+// this many times so that its mean/stddev latency can be computed and reported. Since a run replays
+// the request (and any state-mutating handler behind it) in full, non-idempotent HandlerTests
+// should set HandlerTest.SkipBench to opt out.
+var benchRuns = flag.Int("apitest.bench", 1, "number of times to run each apitest HandlerTest, to compute mean/stddev latency")
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * T E S T   S U I T E
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
@@ -24,6 +47,16 @@ type TestSuite struct {
 	HandlerFunc    http.HandlerFunc
 	AfterTestFunc  func(*testing.T)
 	BeforeTestFunc func(*testing.T)
+
+	// Metrics, if set, records per-test latency, response size and status code for every
+	// HandlerTest run through this suite
+	Metrics *Metrics
+	// MaxLatency, if non-zero, fails any individual HandlerTest (that doesn't set its own
+	// HandlerTest.MaxLatency) whose request takes longer than this to complete
+	MaxLatency time.Duration
+	// MaxP95Latency, if non-zero, fails the suite once RunHandlerTests finishes if the aggregate
+	// p95 latency recorded in Metrics exceeds this budget
+	MaxP95Latency time.Duration
 }
 
 // HandlerTest defines configuration for a single test run for a HandlerFunc. It is run run as part of the TestSuite
@@ -34,24 +67,49 @@ type HandlerTest struct {
 	WantContent         string
 	WantErr             bool
 	WantErrMessage      string
+	WantSchema          string
 	AssertContentFields map[string]AssertFunc
+	AssertPathFields    map[string]AssertFunc
+	Headers             http.Header
+	Cookies             []*http.Cookie
+	QueryParams         url.Values
+	PathParams          map[string]string
+	UseGolden           bool
+	// GoldenIgnoreFields lists dotted/indexed paths (the same syntax AssertPathFields keys use,
+	// e.g. "user.id" or "users[0].id") whose value is replaced with a fixed placeholder before
+	// comparing against the golden file, so nondeterministic values (ids, timestamps, ...) don't
+	// break the diff. Only the exact path given is masked, not every key of that name anywhere in
+	// the document.
+	GoldenIgnoreFields  []string
+	GoldenIgnoreHeaders []string
+	MaxLatency          time.Duration
 	BeforeRunFunc       func(*testing.T)
 	AfterRunFunc        func(*testing.T)
 	SkipBeforeTestFunc  bool
 	SkipAfterTestFunc   bool
+
+	// SkipBench, if true, always runs this HandlerTest exactly once even when the "-apitest.bench"
+	// flag requests N > 1 runs. Set this on tests that hit non-idempotent endpoints (e.g. a
+	// create-vault or invite-user request in a Scenario) so that -apitest.bench can be used on a
+	// suite without duplicate-creating resources or otherwise failing for reasons unrelated to
+	// latency.
+	SkipBench bool
 }
 
-// RunHandlerTests runs all the HandlerTests inside a testing.T.Run() loop
+// RunHandlerTests runs all the HandlerTests inside a testing.T.Run() loop, and reports ts.Metrics
+// (if set) once all the tests have run
 func (ts TestSuite) RunHandlerTests(t *testing.T, tests []HandlerTest) {
 	for _, tt := range tests {
 		t.Run(tt.Name, func(t *testing.T) {
 			ts.RunHandlerTest(t, tt)
 		})
 	}
+	reportMetrics(t, ts.Metrics, ts.MaxP95Latency)
 }
 
-// RunHandlerTest run all the HandlerTest tt
-func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) {
+// RunHandlerTest run all the HandlerTest tt, and returns the response and body it received so that
+// callers (e.g. Scenario) can carry data forward to subsequent requests
+func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) (*http.Response, []byte) {
 
 	// Run BeforeRunFuncs
 	if ts.BeforeTestFunc != nil && !tt.SkipBeforeTestFunc {
@@ -64,12 +122,38 @@ func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) {
 
 	// Create the HTTP request and response
 	hreq := HandlerReqParams{
-		ts.Route,
-		ts.Method,
-		ts.HandlerFunc,
+		Route:       ts.Route,
+		Method:      ts.Method,
+		HandlerFunc: ts.HandlerFunc,
+		Headers:     tt.Headers,
+		Cookies:     tt.Cookies,
+		QueryParams: tt.QueryParams,
+		PathParams:  tt.PathParams,
+	}
+	resp, body := runTimedRequest(t, tt, ts.Metrics, ts.MaxLatency, func() (*http.Response, []byte, error) {
+		return MakeHandlerRequest(hreq, tt.Content, []int{tt.WantStatusCode})
+	})
+
+	// Run AfterRunFuncs
+	if tt.AfterRunFunc != nil {
+		tt.AfterRunFunc(t)
+	}
+
+	if ts.AfterTestFunc != nil && !tt.SkipAfterTestFunc {
+		ts.AfterTestFunc(t)
+	}
+
+	return resp, body
+}
+
+// runResponseAssertions runs all of the HandlerTest's assertions (status code, content, error
+// shape, field/path assertions, schema, golden file) against a received response. It is shared by
+// TestSuite (which calls the HandlerFunc directly) and ServerSuite (which calls it over a real
+// httptest.Server), so that a HandlerTest is fully reusable across both suites.
+func runResponseAssertions(t *testing.T, tt HandlerTest, resp *http.Response, body []byte, err error) {
+	if !assert.NoError(t, err) {
+		return
 	}
-	resp, body, err := MakeHandlerRequest(hreq, tt.Content, []int{tt.WantStatusCode})
-	assert.NoError(t, err)
 
 	// Verify the respoonse
 	assert.Equal(t, tt.WantStatusCode, resp.StatusCode)
@@ -114,15 +198,39 @@ func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) {
 		}
 	}
 
-	// Run AfterRunFuncs
-	if tt.AfterRunFunc != nil {
-		tt.AfterRunFunc(t)
+	// Run the individual assert functions for each of the dotted/indexed path specified in the HTTP response body
+	if tt.AssertPathFields != nil {
+		var rJSON interface{}
+		err = json.Unmarshal(body, &rJSON)
+		if err != nil {
+			t.Error(err)
+		}
+		for path, assertFunc := range tt.AssertPathFields {
+			v, err := getJSONPath(rJSON, path)
+			if err != nil {
+				t.Errorf("could not resolve path '%s' in the response: %s", path, err)
+				continue
+			}
+			assertFunc(t, v)
+		}
 	}
 
-	if ts.AfterTestFunc != nil && !tt.SkipAfterTestFunc {
-		ts.AfterTestFunc(t)
+	// Validate the whole response body against a JSON Schema, if one is provided
+	if tt.WantSchema != "" {
+		result, err := validateJSONSchema(tt.WantSchema, body)
+		if err != nil {
+			t.Errorf("could not validate response against WantSchema: %s", err)
+		} else if !result.Valid() {
+			for _, e := range result.Errors() {
+				t.Errorf("response does not match WantSchema: %s", e)
+			}
+		}
 	}
 
+	// Compare (or record) the response against its golden file
+	if tt.UseGolden {
+		assertGolden(t, tt, resp, body)
+	}
 }
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
@@ -145,6 +253,311 @@ var AssertNotEmptyFunc = func(t *testing.T, v interface{}) {
 	assert.NotEmpty(t, v)
 }
 
+// AssertIsSlice is a of type AssertFunc. It verifies that the value v is a JSON array.
+var AssertIsSlice = func(t *testing.T, v interface{}) {
+	_, ok := v.([]interface{})
+	assert.True(t, ok, "expected value to be a slice but got %T: %v", v, v)
+}
+
+// AssertSliceOfLen returns an AssertFunc that verifies that the value v is a JSON array of length n.
+var AssertSliceOfLen = func(n int) AssertFunc {
+	return func(t *testing.T, v interface{}) {
+		s, ok := v.([]interface{})
+		if !assert.True(t, ok, "expected value to be a slice but got %T: %v", v, v) {
+			return
+		}
+		assert.Len(t, s, n)
+	}
+}
+
+// AssertMatchesRegex returns an AssertFunc that verifies that v is a string and that it matches pattern.
+// A value of any other type (e.g. a JSON number) fails the assertion; it is not converted to a string.
+var AssertMatchesRegex = func(pattern string) AssertFunc {
+	re := regexp.MustCompile(pattern)
+	return func(t *testing.T, v interface{}) {
+		s, ok := v.(string)
+		if !assert.True(t, ok, "expected value to be a string but got %T: %v", v, v) {
+			return
+		}
+		assert.True(t, re.MatchString(s), "expected '%s' to match pattern '%s'", s, pattern)
+	}
+}
+
+// AssertJSONSchema returns an AssertFunc that verifies that the value v validates against the given JSON Schema.
+var AssertJSONSchema = func(schema string) AssertFunc {
+	return func(t *testing.T, v interface{}) {
+		result, err := gojsonschema.Validate(
+			gojsonschema.NewStringLoader(schema),
+			gojsonschema.NewGoLoader(v),
+		)
+		if err != nil {
+			t.Errorf("could not validate value against schema: %s", err)
+			return
+		}
+		if !result.Valid() {
+			for _, e := range result.Errors() {
+				t.Errorf("value does not match schema: %s", e)
+			}
+		}
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T R I C S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Metrics records per-request latency, response size and status code for every HandlerTest run
+// through a TestSuite or ServerSuite that has Metrics set. It is safe for concurrent use.
+type Metrics struct {
+	mu      sync.Mutex
+	records []metricRecord
+}
+
+// metricRecord is a single recorded request
+type metricRecord struct {
+	Name         string
+	Latency      time.Duration
+	ResponseSize int
+	StatusCode   int
+}
+
+// NewMetrics returns an empty, ready-to-use Metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) record(rec metricRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, rec)
+}
+
+// StatusCodeCounts returns how many recorded requests resulted in each status code
+func (m *Metrics) StatusCodeCounts() map[int]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var counts = make(map[int]int)
+	for _, r := range m.records {
+		counts[r.StatusCode]++
+	}
+	return counts
+}
+
+// P95Latency returns the 95th percentile latency across all recorded requests
+func (m *Metrics) P95Latency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.p95Locked()
+}
+
+// p95Locked computes the P95 latency; callers must already hold m.mu
+func (m *Metrics) p95Locked() time.Duration {
+	if len(m.records) == 0 {
+		return 0
+	}
+	var latencies = make([]time.Duration, len(m.records))
+	for i, r := range m.records {
+		latencies[i] = r.Latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(math.Ceil(0.95*float64(len(latencies)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return latencies[idx]
+}
+
+// Summary returns a one-line, human-readable summary of all recorded requests, suitable for t.Log
+func (m *Metrics) Summary() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var counts = make(map[int]int)
+	for _, r := range m.records {
+		counts[r.StatusCode]++
+	}
+	return fmt.Sprintf("apitest: ran %d request(s), p95 latency %s, status distribution %v",
+		len(m.records), m.p95Locked(), counts)
+}
+
+// reportMetrics logs metrics.Summary() (if metrics is set) and fails t if the aggregate p95
+// latency exceeds maxP95Latency
+func reportMetrics(t *testing.T, metrics *Metrics, maxP95Latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+	t.Log(metrics.Summary())
+	if maxP95Latency > 0 {
+		if p95 := metrics.P95Latency(); p95 > maxP95Latency {
+			t.Errorf("apitest: aggregate p95 latency %s exceeds budget of %s", p95, maxP95Latency)
+		}
+	}
+}
+
+// runTimedRequest runs doRequest (and, when the "-apitest.bench" flag is set to N > 1, repeats it N
+// times, unless tt.SkipBench is set), timing each run, asserting the response via
+// runResponseAssertions, recording the result in metrics if set, and failing t if any run exceeds
+// maxLatency (or tt.MaxLatency, if set). It returns the response and body from the last run.
+func runTimedRequest(t *testing.T, tt HandlerTest, metrics *Metrics, maxLatency time.Duration, doRequest func() (*http.Response, []byte, error)) (*http.Response, []byte) {
+	runs := *benchRuns
+	if runs < 1 || tt.SkipBench {
+		runs = 1
+	}
+
+	if tt.MaxLatency > 0 {
+		maxLatency = tt.MaxLatency
+	}
+
+	var resp *http.Response
+	var body []byte
+	var latencies = make([]time.Duration, 0, runs)
+
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		r, b, err := doRequest()
+		elapsed := time.Since(start)
+
+		resp, body = r, b
+		latencies = append(latencies, elapsed)
+
+		runResponseAssertions(t, tt, r, b, err)
+
+		if metrics != nil && r != nil {
+			metrics.record(metricRecord{Name: tt.Name, Latency: elapsed, ResponseSize: len(b), StatusCode: r.StatusCode})
+		}
+
+		if maxLatency > 0 && elapsed > maxLatency {
+			t.Errorf("apitest: test %q took %s on run %d/%d, exceeding MaxLatency of %s", tt.Name, elapsed, i+1, runs, maxLatency)
+		}
+	}
+
+	if runs > 1 {
+		mean, stddev := meanStddevDuration(latencies)
+		t.Logf("apitest.bench: %q ran %d times, mean latency %s, stddev %s", tt.Name, runs, mean, stddev)
+	}
+
+	return resp, body
+}
+
+// meanStddevDuration computes the mean and standard deviation of a slice of durations
+func meanStddevDuration(durations []time.Duration) (time.Duration, time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0
+	}
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	mean := sum / time.Duration(len(durations))
+
+	var variance float64
+	for _, d := range durations {
+		diff := float64(d - mean)
+		variance += diff * diff
+	}
+	variance /= float64(len(durations))
+
+	return mean, time.Duration(math.Sqrt(variance))
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* J S O N   P A T H
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// getJSONPath walks data (the result of unmarshalling a JSON document into an interface{}) and
+// resolves a dotted/JSONPath-style path such as "data.users[0].id". It supports plain object keys
+// separated by "." and array indices specified as "[i]" appended to the preceding key.
+func getJSONPath(data interface{}, path string) (interface{}, error) {
+	var cur = data
+	for _, part := range strings.Split(path, ".") {
+		key, indices, err := splitPathPart(part)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != "" {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an object while resolving key '%s', got %T", key, cur)
+			}
+			v, exists := m[key]
+			if !exists {
+				return nil, fmt.Errorf("key '%s' does not exist", key)
+			}
+			cur = v
+		}
+
+		for _, idx := range indices {
+			s, ok := cur.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an array while resolving index [%d], got %T", idx, cur)
+			}
+			if idx < 0 || idx >= len(s) {
+				return nil, fmt.Errorf("index [%d] is out of bounds for slice of length %d", idx, len(s))
+			}
+			cur = s[idx]
+		}
+	}
+	return cur, nil
+}
+
+// splitPathPart splits a single "."-separated path segment, such as "users[0][1]", into its
+// leading object key ("users") and its ordered list of array indices ([0, 1]).
+func splitPathPart(part string) (string, []int, error) {
+	var key = part
+	var indices []int
+
+	for {
+		start := strings.IndexByte(key, '[')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(key[start:], ']')
+		if end == -1 {
+			return "", nil, fmt.Errorf("unmatched '[' in path part '%s'", part)
+		}
+		end += start
+
+		idx, err := strconv.Atoi(key[start+1 : end])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid array index in path part '%s': %s", part, err)
+		}
+		indices = append(indices, idx)
+		key = key[:start] + key[end+1:]
+	}
+
+	return key, indices, nil
+}
+
+// LoadJSONSchemaFile reads the JSON Schema document at path and returns it as a string, suitable
+// for assigning to HandlerTest.WantSchema
+func LoadJSONSchemaFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("apitest: could not read JSON Schema file %s: %s", path, err)
+	}
+	return string(b), nil
+}
+
+// LoadJSONSchemaReader reads a JSON Schema document from r and returns it as a string, suitable
+// for assigning to HandlerTest.WantSchema
+func LoadJSONSchemaReader(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("apitest: could not read JSON Schema from reader: %s", err)
+	}
+	return string(b), nil
+}
+
+// validateJSONSchema validates a raw JSON document against a JSON Schema document given as a raw
+// JSON string (gojsonschema.NewStringLoader does not accept YAML). Use LoadJSONSchemaFile or
+// LoadJSONSchemaReader to populate a HandlerTest's WantSchema from a JSON schema file or io.Reader.
+func validateJSONSchema(schema string, document []byte) (*gojsonschema.Result, error) {
+	return gojsonschema.Validate(
+		gojsonschema.NewStringLoader(schema),
+		gojsonschema.NewBytesLoader(document),
+	)
+}
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * H A N D L E R   R E Q U E S T
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
@@ -154,6 +567,10 @@ type HandlerReqParams struct {
 	Route       string
 	Method      string
 	HandlerFunc http.HandlerFunc
+	Headers     http.Header
+	Cookies     []*http.Cookie
+	QueryParams url.Values
+	PathParams  map[string]string
 	// Content             string
 	// AcceptedStatusCodes []int
 }
@@ -163,9 +580,20 @@ type HandlerReqParams struct {
 func MakeHandlerRequest(p HandlerReqParams, content string, acceptedStatusCodes []int) (*http.Response, []byte, error) {
 	// Create the HTTP request and response
 	var buff = bytes.NewBufferString(content)
-	var r = httptest.NewRequest(p.Method, p.Route, buff)
+	var route = buildRoute(p.Route, p.PathParams, p.QueryParams)
+	var r = httptest.NewRequest(p.Method, route, buff)
 	var w = httptest.NewRecorder()
 
+	// Attach any headers and cookies the caller wants on the request
+	for k, vals := range p.Headers {
+		for _, v := range vals {
+			r.Header.Add(k, v)
+		}
+	}
+	for _, c := range p.Cookies {
+		r.AddCookie(c)
+	}
+
 	// Call the Handler
 	p.HandlerFunc(w, r)
 
@@ -190,3 +618,383 @@ func MakeHandlerRequest(p HandlerReqParams, content string, acceptedStatusCodes
 
 	return resp, body, nil
 }
+
+// buildRoute substitutes pathParams into route (supporting both the "{key}" and ":key" placeholder
+// styles) and appends queryParams as a query string
+func buildRoute(route string, pathParams map[string]string, queryParams url.Values) string {
+	for k, v := range pathParams {
+		route = strings.ReplaceAll(route, "{"+k+"}", v)
+		route = colonParamPattern(k).ReplaceAllString(route, v)
+	}
+	if len(queryParams) > 0 {
+		route = route + "?" + queryParams.Encode()
+	}
+	return route
+}
+
+// colonParamPattern returns a regexp matching a ":key"-style placeholder for k, requiring a word
+// boundary after the key so that, e.g., ":vaultID" does not also match the leading "vaultID" of a
+// longer placeholder such as ":vaultIDToken".
+func colonParamPattern(k string) *regexp.Regexp {
+	return regexp.MustCompile(`:` + regexp.QuoteMeta(k) + `\b`)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* S E R V E R   S U I T E
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ServerSuite is the real-server counterpart to TestSuite: instead of invoking a HandlerFunc
+// directly against an httptest.ResponseRecorder, it sends requests over the network to an
+// httptest.Server wrapping the module's real http.Handler (router, middleware, auth, panic
+// recovery, CORS, ...). A HandlerTest can be run against either suite unchanged.
+type ServerSuite struct {
+	Route          string
+	Method         string
+	Client         *http.Client
+	AfterTestFunc  func(*testing.T)
+	BeforeTestFunc func(*testing.T)
+
+	// Metrics, MaxLatency and MaxP95Latency mirror their TestSuite counterparts
+	Metrics       *Metrics
+	MaxLatency    time.Duration
+	MaxP95Latency time.Duration
+
+	server *httptest.Server
+}
+
+// NewServerSuite starts an httptest.Server wrapping handler and returns a ServerSuite that makes
+// requests against it for the given route and method. Callers must call Close() once done with the
+// suite (e.g. via defer) to shut the server down.
+func NewServerSuite(handler http.Handler, route, method string) *ServerSuite {
+	return &ServerSuite{
+		Route:  route,
+		Method: method,
+		server: httptest.NewServer(handler),
+	}
+}
+
+// Close shuts down the underlying httptest.Server. It should be deferred by the caller right after
+// NewServerSuite.
+func (ss *ServerSuite) Close() {
+	ss.server.Close()
+}
+
+// RunHandlerTests runs all the HandlerTests inside a testing.T.Run() loop, and reports ss.Metrics
+// (if set) once all the tests have run
+func (ss *ServerSuite) RunHandlerTests(t *testing.T, tests []HandlerTest) {
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			ss.RunHandlerTest(t, tt)
+		})
+	}
+	reportMetrics(t, ss.Metrics, ss.MaxP95Latency)
+}
+
+// RunHandlerTest runs the HandlerTest tt against the real server, and returns the response and body
+// it received so that callers (e.g. Scenario) can carry data forward to subsequent requests
+func (ss *ServerSuite) RunHandlerTest(t *testing.T, tt HandlerTest) (*http.Response, []byte) {
+
+	// Run BeforeRunFuncs
+	if ss.BeforeTestFunc != nil && !tt.SkipBeforeTestFunc {
+		ss.BeforeTestFunc(t)
+	}
+
+	if tt.BeforeRunFunc != nil {
+		tt.BeforeRunFunc(t)
+	}
+
+	client := ss.Client
+	if client == nil {
+		client = ss.server.Client()
+	}
+
+	sreq := ServerReqParams{
+		BaseURL:     ss.server.URL,
+		Route:       ss.Route,
+		Method:      ss.Method,
+		Headers:     tt.Headers,
+		Cookies:     tt.Cookies,
+		QueryParams: tt.QueryParams,
+		PathParams:  tt.PathParams,
+	}
+	resp, body := runTimedRequest(t, tt, ss.Metrics, ss.MaxLatency, func() (*http.Response, []byte, error) {
+		return MakeServerRequest(client, sreq, tt.Content, []int{tt.WantStatusCode})
+	})
+
+	// Run AfterRunFuncs
+	if tt.AfterRunFunc != nil {
+		tt.AfterRunFunc(t)
+	}
+
+	if ss.AfterTestFunc != nil && !tt.SkipAfterTestFunc {
+		ss.AfterTestFunc(t)
+	}
+
+	return resp, body
+}
+
+// ServerReqParams define a set of configuration that allow us to make repeated requests to a real
+// httptest.Server
+type ServerReqParams struct {
+	BaseURL     string
+	Route       string
+	Method      string
+	Headers     http.Header
+	Cookies     []*http.Cookie
+	QueryParams url.Values
+	PathParams  map[string]string
+}
+
+// MakeServerRequest makes a real HTTP request, using client, to the server and route specified in
+// p. It errors if there is an error making the request, or if the received status code is not
+// among the accepted status codes. If client is nil, http.DefaultClient is used.
+func MakeServerRequest(client *http.Client, p ServerReqParams, content string, acceptedStatusCodes []int) (*http.Response, []byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var route = buildRoute(p.Route, p.PathParams, p.QueryParams)
+	req, err := http.NewRequest(p.Method, p.BaseURL+route, bytes.NewBufferString(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, vals := range p.Headers {
+		for _, v := range vals {
+			req.Header.Add(k, v)
+		}
+	}
+	for _, c := range p.Cookies {
+		req.AddCookie(c)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, body, err
+	}
+
+	// Check if the response status is one of the accepted ones
+	if len(acceptedStatusCodes) > 0 {
+		var statusMap = make(map[int]bool)
+		for _, status := range acceptedStatusCodes {
+			statusMap[status] = true
+		}
+		if v, hasKey := statusMap[resp.StatusCode]; !hasKey || !v {
+			return resp, body, fmt.Errorf("apitest: server request to %s resulted in a unaccepteable %d status:\n%s", p.Route, resp.StatusCode, string(body))
+		}
+	}
+
+	return resp, body, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* G O L D E N   F I L E S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// goldenRecord is the shape persisted to (and read from) a HandlerTest's golden file
+type goldenRecord struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       interface{}         `json:"body"`
+}
+
+// assertGolden compares resp/body against the HandlerTest's golden file, writing a new golden file
+// instead of comparing if the "-apitest.update" flag was passed
+func assertGolden(t *testing.T, tt HandlerTest, resp *http.Response, body []byte) {
+	var parsedBody interface{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &parsedBody); err != nil {
+			t.Errorf("apitest: could not parse response body as JSON for golden comparison: %s", err)
+			return
+		}
+	}
+	normalizeGoldenFields(parsedBody, tt.GoldenIgnoreFields)
+
+	record := goldenRecord{
+		StatusCode: resp.StatusCode,
+		Headers:    normalizeGoldenHeaders(resp.Header, tt.GoldenIgnoreHeaders),
+		Body:       parsedBody,
+	}
+	got, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		t.Errorf("apitest: could not marshal golden record: %s", err)
+		return
+	}
+
+	path := goldenFilePath(t.Name())
+
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("apitest: could not create testdata directory for golden file %s: %s", path, err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("apitest: could not write golden file %s: %s", path, err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("apitest: golden file %s does not exist; run the test with -apitest.update to create it: %s", path, err)
+	}
+
+	assert.JSONEq(t, string(want), string(got))
+}
+
+// goldenFilePath returns the testdata/<TestName>.golden.json path for a t.Name(), which already
+// encodes the full subtest hierarchy (e.g. "TestWidgets/list"). Using t.Name() rather than
+// HandlerTest.Name means two HandlerTests that happen to reuse a common Name like "success" still
+// get distinct golden files.
+func goldenFilePath(testName string) string {
+	var safe = strings.NewReplacer(" ", "_", "/", "_").Replace(testName)
+	return filepath.Join("testdata", safe+".golden.json")
+}
+
+// normalizeGoldenFields replaces the value found at each dotted/indexed path in fields (resolved
+// the same way getJSONPath resolves an AssertPathFields key) with a fixed placeholder, so
+// nondeterministic values (ids, timestamps, ...) don't break golden file diffs. A path that
+// doesn't resolve (e.g. a field only present in some responses) is left alone.
+func normalizeGoldenFields(data interface{}, fields []string) {
+	for _, path := range fields {
+		maskGoldenPath(data, path)
+	}
+}
+
+// maskGoldenPath walks data along path, using the same dotted/indexed syntax and traversal rules
+// as getJSONPath, and overwrites the value found there (if any) with "<ignored>".
+func maskGoldenPath(data interface{}, path string) {
+	var cur = data
+	var parts = strings.Split(path, ".")
+	for i, part := range parts {
+		key, indices, err := splitPathPart(part)
+		if err != nil {
+			return
+		}
+		last := i == len(parts)-1
+
+		if key != "" {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return
+			}
+			if last && len(indices) == 0 {
+				if _, exists := m[key]; exists {
+					m[key] = "<ignored>"
+				}
+				return
+			}
+			v, exists := m[key]
+			if !exists {
+				return
+			}
+			cur = v
+		}
+
+		for j, idx := range indices {
+			s, ok := cur.([]interface{})
+			if !ok || idx < 0 || idx >= len(s) {
+				return
+			}
+			if last && j == len(indices)-1 {
+				s[idx] = "<ignored>"
+				return
+			}
+			cur = s[idx]
+		}
+	}
+}
+
+// volatileGoldenHeaders lists response headers that are expected to change from run to run even
+// when the response they describe is otherwise identical (e.g. the "Date" header net/http stamps
+// on every response served by a real httptest.Server, see ServerSuite). They are dropped from the
+// golden record by default so UseGolden tests don't flake; callers can ignore additional headers
+// (rather than dropping them outright) via GoldenIgnoreHeaders.
+var volatileGoldenHeaders = map[string]bool{
+	"Date": true,
+}
+
+// normalizeGoldenHeaders copies h, dropping the default volatile headers and replacing the value
+// of any header named in ignoreHeaders with a fixed placeholder
+func normalizeGoldenHeaders(h http.Header, ignoreHeaders []string) map[string][]string {
+	var ignore = make(map[string]bool, len(ignoreHeaders))
+	for _, name := range ignoreHeaders {
+		ignore[http.CanonicalHeaderKey(name)] = true
+	}
+
+	var headers = make(map[string][]string, len(h))
+	for k, vals := range h {
+		if volatileGoldenHeaders[k] {
+			continue
+		}
+		if ignore[k] {
+			headers[k] = []string{"<ignored>"}
+			continue
+		}
+		headers[k] = vals
+	}
+	return headers
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* S C E N A R I O
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Scenario chains a sequence of ScenarioSteps together, carrying a mutable Context between them so
+// that later steps can reuse data (e.g. an auth token) produced by earlier ones. This turns apitest
+// from a per-endpoint helper into an integration-test harness for multi-request flows such as
+// login -> create vault -> invite user.
+type Scenario struct {
+	Name    string
+	Context map[string]interface{}
+}
+
+// Suite is implemented by both TestSuite and *ServerSuite. ScenarioStep.Suite is typed as Suite
+// (rather than the concrete TestSuite) so that a multi-step Scenario can mix steps that run
+// in-process with steps that run against a real ServerSuite, e.g. a login step that doesn't need
+// middleware followed by a create-vault step that does.
+type Suite interface {
+	RunHandlerTest(t *testing.T, tt HandlerTest) (*http.Response, []byte)
+}
+
+// ScenarioStep defines a single request within a Scenario. BeforeRunFunc is called with the
+// Scenario's Context before the request is made, and may mutate Test (e.g. to add a header read
+// from Context). AfterRunFunc is called with the raw response body after the request completes, and
+// may store data into Context for use by later steps.
+type ScenarioStep struct {
+	Suite         Suite
+	Test          HandlerTest
+	BeforeRunFunc func(t *testing.T, ctx map[string]interface{}, tt *HandlerTest)
+	AfterRunFunc  func(t *testing.T, ctx map[string]interface{}, body []byte)
+}
+
+// NewScenario creates a Scenario with an initialized, empty Context
+func NewScenario(name string) *Scenario {
+	return &Scenario{
+		Name:    name,
+		Context: make(map[string]interface{}),
+	}
+}
+
+// Run runs each of the steps in order inside a testing.T.Run() loop, threading s.Context between them
+func (s *Scenario) Run(t *testing.T, steps []ScenarioStep) {
+	for _, step := range steps {
+		t.Run(step.Test.Name, func(t *testing.T) {
+			var tt = step.Test
+
+			if step.BeforeRunFunc != nil {
+				step.BeforeRunFunc(t, s.Context, &tt)
+			}
+
+			_, body := step.Suite.RunHandlerTest(t, tt)
+
+			if step.AfterRunFunc != nil {
+				step.AfterRunFunc(t, s.Context, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJSONPath(t *testing.T) {
+	var data interface{} = map[string]interface{}{
+		"data": map[string]interface{}{
+			"users": []interface{}{
+				map[string]interface{}{"id": "u1"},
+				map[string]interface{}{"id": "u2"},
+			},
+		},
+	}
+
+	tests := []struct {
+		Name    string
+		Path    string
+		Want    interface{}
+		WantErr bool
+	}{
+		{Name: "nested key", Path: "data.users[0].id", Want: "u1"},
+		{Name: "second index", Path: "data.users[1].id", Want: "u2"},
+		{Name: "missing key", Path: "data.missing", WantErr: true},
+		{Name: "out of bounds index", Path: "data.users[5].id", WantErr: true},
+		{Name: "unmatched bracket", Path: "data.users[0", WantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got, err := getJSONPath(data, tt.Path)
+			if tt.WantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Want, got)
+		})
+	}
+}
+
+// widgetHandler is a stub HandlerFunc returning a fixed JSON body, used by
+// TestRunHandlerTest_SchemaAndPathAssertions to drive WantSchema, AssertContentFields and
+// AssertPathFields together against one real response.
+func widgetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"id":"abc123","tags":["a","b","c"],"meta":{"name":"widget-1"}}`))
+}
+
+func TestRunHandlerTest_SchemaAndPathAssertions(t *testing.T) {
+	suite := TestSuite{
+		Route:       "/widgets/:id",
+		Method:      http.MethodGet,
+		HandlerFunc: widgetHandler,
+	}
+
+	tt := HandlerTest{
+		Name:           "get widget",
+		WantStatusCode: http.StatusOK,
+		WantSchema: `{
+			"type": "object",
+			"required": ["id", "tags"],
+			"properties": {
+				"id": {"type": "string"},
+				"tags": {"type": "array"}
+			}
+		}`,
+		AssertContentFields: map[string]AssertFunc{
+			"tags": AssertIsSlice,
+			"meta": AssertJSONSchema(`{"type": "object", "required": ["name"]}`),
+		},
+		AssertPathFields: map[string]AssertFunc{
+			"id":        AssertMatchesRegex(`^[a-z0-9]+$`),
+			"tags":      AssertSliceOfLen(3),
+			"meta.name": AssertMatchesRegex(`^widget-\d+$`),
+		},
+	}
+
+	suite.RunHandlerTest(t, tt)
+}
+
+func TestBuildRoute(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Route       string
+		PathParams  map[string]string
+		QueryParams url.Values
+		Want        string
+	}{
+		{
+			Name:       "brace style",
+			Route:      "/vaults/{vaultID}",
+			PathParams: map[string]string{"vaultID": "abc"},
+			Want:       "/vaults/abc",
+		},
+		{
+			Name:       "colon style",
+			Route:      "/vaults/:vaultID",
+			PathParams: map[string]string{"vaultID": "abc"},
+			Want:       "/vaults/abc",
+		},
+		{
+			Name:       "colon style does not corrupt a placeholder whose name is a prefix of another",
+			Route:      "/vaults/:vaultID/tokens/:vaultIDToken",
+			PathParams: map[string]string{"vaultID": "abc"},
+			Want:       "/vaults/abc/tokens/:vaultIDToken",
+		},
+		{
+			Name:       "colon style substitutes both placeholders when both are given",
+			Route:      "/vaults/:vaultID/tokens/:vaultIDToken",
+			PathParams: map[string]string{"vaultID": "abc", "vaultIDToken": "xyz"},
+			Want:       "/vaults/abc/tokens/xyz",
+		},
+		{
+			Name:        "with query params",
+			Route:       "/vaults/:vaultID",
+			PathParams:  map[string]string{"vaultID": "abc"},
+			QueryParams: url.Values{"page": []string{"2"}},
+			Want:        "/vaults/abc?page=2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got := buildRoute(tt.Route, tt.PathParams, tt.QueryParams)
+			assert.Equal(t, tt.Want, got)
+		})
+	}
+}
+
+func TestNormalizeGoldenFields(t *testing.T) {
+	data := map[string]interface{}{
+		"id":   "should-be-ignored",
+		"name": "keep-me",
+		"nested": map[string]interface{}{
+			"id": "also-ignored",
+		},
+	}
+
+	normalizeGoldenFields(data, []string{"id", "nested.id"})
+
+	assert.Equal(t, "<ignored>", data["id"])
+	assert.Equal(t, "keep-me", data["name"])
+	assert.Equal(t, "<ignored>", data["nested"].(map[string]interface{})["id"])
+}
+
+// TestNormalizeGoldenFields_OnlyMasksGivenPath covers the case GoldenIgnoreFields exists for: a
+// document with the same key nested under two different objects (e.g. a create-vault response
+// returning both the user and the vault it belongs to, each with an "id"). Naming "user.id" must
+// not also mask "vault.id".
+func TestNormalizeGoldenFields_OnlyMasksGivenPath(t *testing.T) {
+	data := map[string]interface{}{
+		"user":  map[string]interface{}{"id": "should-be-ignored"},
+		"vault": map[string]interface{}{"id": "keep-me"},
+	}
+
+	normalizeGoldenFields(data, []string{"user.id"})
+
+	assert.Equal(t, "<ignored>", data["user"].(map[string]interface{})["id"])
+	assert.Equal(t, "keep-me", data["vault"].(map[string]interface{})["id"])
+}
+
+func TestNormalizeGoldenHeaders(t *testing.T) {
+	h := http.Header{
+		"Date":         []string{"Wed, 29 Jul 2026 00:00:00 GMT"},
+		"X-Request-Id": []string{"req-123"},
+		"Content-Type": []string{"application/json"},
+	}
+
+	got := normalizeGoldenHeaders(h, []string{"X-Request-Id"})
+
+	_, hasDate := got["Date"]
+	assert.False(t, hasDate, "Date is volatile and should be dropped by default")
+	assert.Equal(t, []string{"<ignored>"}, got["X-Request-Id"])
+	assert.Equal(t, []string{"application/json"}, got["Content-Type"])
+}
+
+// TestAssertGolden_WriteThenCompare writes a golden file with -apitest.update set and then replays
+// the same HandlerTest with it cleared, to catch a write path and compare path that disagree about
+// the record shape (a mismatch the normalizer unit tests above wouldn't see).
+func TestAssertGolden_WriteThenCompare(t *testing.T) {
+	suite := TestSuite{
+		Route:       "/widgets",
+		Method:      http.MethodGet,
+		HandlerFunc: widgetHandler,
+	}
+	tt := HandlerTest{
+		Name:           "golden widget",
+		WantStatusCode: http.StatusOK,
+		UseGolden:      true,
+	}
+
+	path := goldenFilePath(t.Name())
+	t.Cleanup(func() { os.Remove(path) })
+
+	*updateGolden = true
+	suite.RunHandlerTest(t, tt)
+	*updateGolden = false
+	t.Cleanup(func() { *updateGolden = false })
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected -apitest.update to write golden file %s: %s", path, err)
+	}
+
+	// A second run against the same, unchanged handler should compare cleanly against the file
+	// just written.
+	suite.RunHandlerTest(t, tt)
+}
+
+// TestAssertGolden_PathKeyedBySubtestName covers two HandlerTests that reuse the same
+// HandlerTest.Name ("same") from different subtests: their golden files must not collide, since
+// goldenFilePath is keyed by t.Name() (which includes the subtest path), not by HandlerTest.Name.
+func TestAssertGolden_PathKeyedBySubtestName(t *testing.T) {
+	widgetSuite := TestSuite{Route: "/widgets", Method: http.MethodGet, HandlerFunc: widgetHandler}
+	otherHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id":"zzz999"}`))
+	}
+	otherSuite := TestSuite{Route: "/other", Method: http.MethodGet, HandlerFunc: otherHandler}
+
+	tt := HandlerTest{Name: "same", WantStatusCode: http.StatusOK, UseGolden: true}
+
+	*updateGolden = true
+	t.Cleanup(func() { *updateGolden = false })
+
+	var pathA, pathB string
+	t.Run("a", func(t *testing.T) {
+		pathA = goldenFilePath(t.Name())
+		widgetSuite.RunHandlerTest(t, tt)
+		_, err := os.Stat(pathA)
+		assert.NoError(t, err)
+	})
+	t.Run("b", func(t *testing.T) {
+		pathB = goldenFilePath(t.Name())
+		otherSuite.RunHandlerTest(t, tt)
+		_, err := os.Stat(pathB)
+		assert.NoError(t, err)
+	})
+	t.Cleanup(func() {
+		os.Remove(pathA)
+		os.Remove(pathB)
+	})
+
+	assert.NotEqual(t, pathA, pathB)
+}
+
+func TestMeanStddevDuration(t *testing.T) {
+	durations := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		300 * time.Millisecond,
+	}
+
+	mean, stddev := meanStddevDuration(durations)
+
+	assert.Equal(t, 200*time.Millisecond, mean)
+	assert.InDelta(t, float64(81649658), float64(stddev), float64(time.Millisecond))
+}
+
+func TestMetricsP95Latency(t *testing.T) {
+	m := NewMetrics()
+	for i := 1; i <= 10; i++ {
+		m.record(metricRecord{Name: "t", Latency: time.Duration(i) * time.Millisecond, StatusCode: 200})
+	}
+
+	assert.Equal(t, 10*time.Millisecond, m.P95Latency())
+	assert.Equal(t, map[int]int{200: 10}, m.StatusCodeCounts())
+}
+
+// TestRunTimedRequest_BenchReplaysAndSkipBench asserts runTimedRequest calls doRequest benchRuns
+// times when "-apitest.bench" is set above 1, and exactly once when SkipBench is set regardless —
+// the replay count itself, not the mean/stddev math derived from it in the tests above.
+func TestRunTimedRequest_BenchReplaysAndSkipBench(t *testing.T) {
+	original := *benchRuns
+	t.Cleanup(func() { *benchRuns = original })
+
+	var calls int
+	doRequest := func() (*http.Response, []byte, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusOK}, []byte(`{}`), nil
+	}
+
+	*benchRuns = 3
+	metrics := NewMetrics()
+	tt := HandlerTest{Name: "bench me", WantStatusCode: http.StatusOK}
+	runTimedRequest(t, tt, metrics, 0, doRequest)
+	assert.Equal(t, 3, calls)
+	assert.Len(t, metrics.records, 3)
+
+	calls = 0
+	metrics = NewMetrics()
+	ttSkip := HandlerTest{Name: "bench me, but not this one", WantStatusCode: http.StatusOK, SkipBench: true}
+	runTimedRequest(t, ttSkip, metrics, 0, doRequest)
+	assert.Equal(t, 1, calls)
+	assert.Len(t, metrics.records, 1)
+}
+
+// echoHandler is a stub http.Handler that reflects back the path, query param, header and cookie it
+// received, so TestServerSuite_RealNetworkRoundTrip can confirm MakeServerRequest actually puts them
+// on the wire rather than assuming parity with MakeHandlerRequest's in-process request building.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var cookie string
+	if c, err := r.Cookie("session"); err == nil {
+		cookie = c.Value
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   r.URL.Path,
+		"query":  r.URL.Query().Get("page"),
+		"header": r.Header.Get("X-Test-Header"),
+		"cookie": cookie,
+	})
+}
+
+// tokenHandler is a stub HandlerFunc standing in for a login endpoint: it returns a token in the
+// response body for a Scenario step to carry forward.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": "tok-abc123"})
+}
+
+// authEchoHandler is a stub http.Handler standing in for an authenticated endpoint: it echoes back
+// whatever Authorization header it received, so a test can assert a prior step's token arrived.
+func authEchoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"authorization": r.Header.Get("Authorization")})
+}
+
+// TestScenario_ContextThreading covers login -> create vault, the case Scenario exists for: step
+// one's AfterRunFunc pulls a token out of the response body into Context, and step two's
+// BeforeRunFunc reads it back out to set the Authorization header on the next request. Step two
+// runs through a ServerSuite rather than a TestSuite, which only works because ScenarioStep.Suite
+// is the Suite interface both suite types satisfy.
+func TestScenario_ContextThreading(t *testing.T) {
+	loginSuite := TestSuite{
+		Route:       "/login",
+		Method:      http.MethodPost,
+		HandlerFunc: tokenHandler,
+	}
+
+	vaultSuite := NewServerSuite(http.HandlerFunc(authEchoHandler), "/vaults", http.MethodPost)
+	defer vaultSuite.Close()
+
+	scenario := NewScenario("login then authenticated request")
+
+	steps := []ScenarioStep{
+		{
+			Suite: loginSuite,
+			Test:  HandlerTest{Name: "login", WantStatusCode: http.StatusOK},
+			AfterRunFunc: func(t *testing.T, ctx map[string]interface{}, body []byte) {
+				var resp struct {
+					Token string `json:"token"`
+				}
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatal(err)
+				}
+				ctx["token"] = resp.Token
+			},
+		},
+		{
+			Suite: vaultSuite,
+			Test: HandlerTest{
+				Name:           "create vault",
+				WantStatusCode: http.StatusOK,
+				AssertContentFields: map[string]AssertFunc{
+					"authorization": AssertIsEqual("Bearer tok-abc123"),
+				},
+			},
+			BeforeRunFunc: func(t *testing.T, ctx map[string]interface{}, tt *HandlerTest) {
+				tt.Headers = http.Header{"Authorization": []string{"Bearer " + ctx["token"].(string)}}
+			},
+		},
+	}
+
+	scenario.Run(t, steps)
+}
+
+func TestServerSuite_RealNetworkRoundTrip(t *testing.T) {
+	ss := NewServerSuite(http.HandlerFunc(echoHandler), "/widgets/:id", http.MethodGet)
+	defer ss.Close()
+
+	tt := HandlerTest{
+		Name:           "server suite echo",
+		WantStatusCode: http.StatusOK,
+		PathParams:     map[string]string{"id": "abc"},
+		QueryParams:    url.Values{"page": []string{"2"}},
+		Headers:        http.Header{"X-Test-Header": []string{"hello"}},
+		Cookies:        []*http.Cookie{{Name: "session", Value: "s3ss"}},
+		AssertContentFields: map[string]AssertFunc{
+			"path":   AssertIsEqual("/widgets/abc"),
+			"query":  AssertIsEqual("2"),
+			"header": AssertIsEqual("hello"),
+			"cookie": AssertIsEqual("s3ss"),
+		},
+	}
+
+	ss.RunHandlerTest(t, tt)
+}